@@ -0,0 +1,129 @@
+package dnsserver
+
+import (
+	"net"
+	"strings"
+)
+
+// defaultNetwork is used when a zone key carries no explicit network
+// prefix, preserving the historic behavior of serving both TCP and UDP
+// on the same address.
+const defaultNetwork = "tcp"
+
+// knownNetworks lists the networks a "network/" zone key prefix may
+// select. unix sockets and TLS-wrapped TCP (DoT) are grouped alongside
+// plain tcp/udp so a single Corefile can mix them freely.
+// fd and fdgram select a systemd socket-activated stream or datagram
+// socket directly, by name or by index, instead of resolving a
+// host:port.
+var knownNetworks = map[string]bool{
+	"tcp":     true,
+	"tcp4":    true,
+	"tcp6":    true,
+	"tcp-tls": true,
+	"udp":     true,
+	"udp4":    true,
+	"udp6":    true,
+	"unix":    true,
+	"fd":      true,
+	"fdgram":  true,
+}
+
+// ParsedNetworkAddress is a bind address broken into the network it
+// should be served on (tcp, udp, tcp6, tcp-tls, unix, ...), the host and
+// the port. Grouping configs by the full triple - rather than just
+// host:port - lets identical hostports on different networks coexist,
+// e.g. a plain UDP listener and a DoT listener on the same :53.
+type ParsedNetworkAddress struct {
+	Network string
+	Host    string
+	Port    string
+}
+
+// String returns the string representation of p.
+func (p ParsedNetworkAddress) String() string {
+	if p.Network == "" || p.Network == "unix" {
+		return p.Network + "/" + p.Host
+	}
+	return p.Network + "/" + net.JoinHostPort(p.Host, p.Port)
+}
+
+// zoneAddr contains the zone, port and network for a site.
+type zoneAddr struct {
+	Zone    string
+	Port    string
+	Network string
+
+	// SocketName selects one socket-activated file descriptor among
+	// several. For Network "fd"/"fdgram" it is the raw descriptor
+	// index ("3"); otherwise it is a systemd FileDescriptorName
+	// matched against a "sa" (socket activation) port, e.g.
+	// ".:sa/coredns-external".
+	SocketName string
+
+	// SocketPath is the filesystem path to bind for Network "unix". It
+	// is kept separate from Zone so a unix-socket server block still
+	// gets a real DNS zone (".", matching fd/fdgram) to route queries
+	// by, instead of routing by socket path.
+	SocketPath string
+}
+
+// String returns the string representation of z.
+func (z zoneAddr) String() string {
+	prefix := ""
+	if z.Network != "" && z.Network != defaultNetwork {
+		prefix = z.Network + "/"
+	}
+
+	switch z.Network {
+	case "unix":
+		return prefix + z.SocketPath
+	case "fd", "fdgram":
+		return prefix + z.SocketName
+	}
+
+	s := z.Zone + ":" + z.Port
+	if z.SocketName != "" {
+		s += "/" + z.SocketName
+	}
+	return prefix + s
+}
+
+// normalizeZone parses a zone key into its normalized form, splitting
+// off an optional "network/" prefix (tcp6/, udp/, tcp-tls/, unix/, fd/,
+// fdgram/) that selects which kind of listener the zone is served on.
+// A key with no prefix keeps the historic default of serving both TCP
+// and UDP. A "sa" port may carry a socket name after a slash, e.g.
+// ".:sa/coredns-external", to pick a specific socket-activated
+// descriptor among several instead of grabbing the first one found.
+func normalizeZone(str string) (zoneAddr, error) {
+	network := defaultNetwork
+	if idx := strings.Index(str, "/"); idx >= 0 && knownNetworks[str[:idx]] {
+		network = str[:idx]
+		str = str[idx+1:]
+	}
+
+	switch network {
+	case "unix":
+		return zoneAddr{Zone: ".", Network: network, SocketPath: str}, nil
+	case "fd", "fdgram":
+		return zoneAddr{Zone: ".", Network: network, SocketName: str}, nil
+	}
+
+	host, port, err := net.SplitHostPort(str)
+	if err != nil {
+		// No port in the key; the caller fills in the default port.
+		host, port = str, ""
+	}
+	if host == "" {
+		host = "."
+	}
+
+	socketName := ""
+	if idx := strings.Index(port, "/"); idx >= 0 {
+		socketName = port[idx+1:]
+		port = port[:idx]
+	}
+
+	return zoneAddr{Zone: host, Port: port, Network: network, SocketName: socketName}, nil
+}
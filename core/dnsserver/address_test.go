@@ -0,0 +1,76 @@
+package dnsserver
+
+import "testing"
+
+func TestNormalizeZone(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    zoneAddr
+		wantErr bool
+	}{
+		{input: "example.org:53", want: zoneAddr{Zone: "example.org", Port: "53", Network: "tcp"}},
+		{input: "example.org", want: zoneAddr{Zone: "example.org", Port: "", Network: "tcp"}},
+		{input: ":53", want: zoneAddr{Zone: ".", Port: "53", Network: "tcp"}},
+		{input: "tcp6/example.org:53", want: zoneAddr{Zone: "example.org", Port: "53", Network: "tcp6"}},
+		{input: "udp/example.org:53", want: zoneAddr{Zone: "example.org", Port: "53", Network: "udp"}},
+		{input: "tcp-tls/example.org:853", want: zoneAddr{Zone: "example.org", Port: "853", Network: "tcp-tls"}},
+		{input: "unix//var/run/coredns.sock", want: zoneAddr{Zone: ".", Network: "unix", SocketPath: "/var/run/coredns.sock"}},
+		{input: "fd/3", want: zoneAddr{Zone: ".", Network: "fd", SocketName: "3"}},
+		{input: "fdgram/coredns-dns", want: zoneAddr{Zone: ".", Network: "fdgram", SocketName: "coredns-dns"}},
+		{input: ".:sa/coredns-external", want: zoneAddr{Zone: ".", Port: "sa", Network: "tcp", SocketName: "coredns-external"}},
+	}
+
+	for _, tc := range tests {
+		got, err := normalizeZone(tc.input)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("normalizeZone(%q): expected error, got none", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeZone(%q): unexpected error: %s", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("normalizeZone(%q) = %+v, want %+v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestZoneAddrString(t *testing.T) {
+	tests := []struct {
+		in   zoneAddr
+		want string
+	}{
+		{zoneAddr{Zone: "example.org", Port: "53", Network: "tcp"}, "example.org:53"},
+		{zoneAddr{Zone: "example.org", Port: "53", Network: "tcp6"}, "tcp6/example.org:53"},
+		{zoneAddr{Zone: "example.org", Port: "853", Network: "tcp-tls"}, "tcp-tls/example.org:853"},
+		{zoneAddr{Zone: ".", Network: "unix", SocketPath: "/var/run/coredns.sock"}, "unix//var/run/coredns.sock"},
+		{zoneAddr{Zone: ".", Network: "fd", SocketName: "3"}, "fd/3"},
+		{zoneAddr{Zone: ".", Port: "sa", Network: "tcp", SocketName: "coredns-external"}, ".:sa/coredns-external"},
+	}
+
+	for _, tc := range tests {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("zoneAddr%+v.String() = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParsedNetworkAddressString(t *testing.T) {
+	tests := []struct {
+		in   ParsedNetworkAddress
+		want string
+	}{
+		{ParsedNetworkAddress{Network: "tcp", Host: "127.0.0.1", Port: "53"}, "tcp/127.0.0.1:53"},
+		{ParsedNetworkAddress{Network: "tcp6", Host: "::1", Port: "53"}, "tcp6/[::1]:53"},
+		{ParsedNetworkAddress{Network: "unix", Host: "/var/run/coredns.sock"}, "unix//var/run/coredns.sock"},
+	}
+
+	for _, tc := range tests {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("ParsedNetworkAddress%+v.String() = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
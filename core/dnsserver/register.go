@@ -4,8 +4,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"net"
+	"os"
+	"os/exec"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/activation"
@@ -32,10 +38,15 @@ func init() {
 		},
 		NewContext: newContext,
 	})
+
+	trapSignalsForGracefulRestart()
 }
 
 func newContext() caddy.Context {
-	return &dnsContext{keysToConfigs: make(map[string]*Config)}
+	return &dnsContext{
+		keysToConfigs: make(map[string]*Config),
+		serverOpts:    make(map[string]*ServerOptions),
+	}
 }
 
 type dnsContext struct {
@@ -43,6 +54,10 @@ type dnsContext struct {
 
 	// configs is the master list of all site configs.
 	configs []*Config
+
+	// serverOpts holds the per-bind-address tuning knobs parsed from
+	// "servers" directives, keyed by the bind address they apply to.
+	serverOpts map[string]*ServerOptions
 }
 
 func (h *dnsContext) saveConfig(key string, cfg *Config) {
@@ -52,26 +67,63 @@ func (h *dnsContext) saveConfig(key string, cfg *Config) {
 
 // InspectServerBlocks make sure that everything checks out before
 // executing directives and otherwise prepares the directives to
-// be parsed and executed.
+// be parsed and executed. Ambiguous zone definitions - the same zone
+// served twice - are not rejected here, because at this point the
+// bind address isn't resolved yet and two configs that will end up on
+// different addresses (e.g. an internal view on 127.0.0.1:53 and an
+// external view on 0.0.0.0:5353) are perfectly legitimate. That check
+// happens later, in groupConfigsByListenAddr, once addresses are known.
 func (h *dnsContext) InspectServerBlocks(sourceFile string, serverBlocks []caddyfile.ServerBlock) ([]caddyfile.ServerBlock, error) {
-	// Normalize and check all the zone names and check for duplicates
-	dups := map[string]string{}
 	for _, s := range serverBlocks {
+		if tokens, ok := s.Tokens["servers"]; ok {
+			opts, err := parseServerOptions(caddyfile.NewDispenserTokens(sourceFile, tokens))
+			if err != nil {
+				return nil, err
+			}
+			// Key serverOpts by the same resolved ParsedNetworkAddress
+			// string groupConfigsByListenAddr groups configs under -
+			// not the raw address text - so a "servers 127.0.0.1:53"
+			// override actually matches the "tcp/127.0.0.1:53" group
+			// it targets instead of silently never applying. This
+			// still assumes the targeted zone resolves to the same
+			// host: groupConfigsByListenAddr resolves a zone's bind
+			// host from Config.ListenHost (set by a "bind" directive),
+			// not from the zone key text, so "servers" only lines up
+			// with a zone that binds the host it names.
+			for addr, so := range opts {
+				za, err := normalizeZone(addr)
+				if err != nil {
+					return nil, fmt.Errorf("servers %s: %s", addr, err)
+				}
+				pna, err := resolveListenAddr(za.Network, za.Zone, za.Port, za.SocketName, za.SocketPath)
+				if err != nil {
+					return nil, fmt.Errorf("servers %s: %s", addr, err)
+				}
+				h.serverOpts[pna.String()] = so
+			}
+		}
+
 		for i, k := range s.Keys {
 			za, err := normalizeZone(k)
 			if err != nil {
 				return nil, err
 			}
 			s.Keys[i] = za.String()
-			if v, ok := dups[za.Zone]; ok {
-				return nil, fmt.Errorf("cannot serve %s - zone already defined for %v", za, v)
-			}
-			dups[za.Zone] = za.String()
 
 			// Save the config to our master list, and key it for lookups
 			cfg := &Config{
-				Zone: za.Zone,
-				Port: za.Port,
+				Zone:       za.Zone,
+				Port:       za.Port,
+				Network:    za.Network,
+				SocketName: za.SocketName,
+				SocketPath: za.SocketPath,
+
+				// Only the first zone key in a server block runs the
+				// block's OnStartup, OnShutdown and OnFinalShutdown
+				// callbacks (see MakeServers); the rest would otherwise
+				// register the same metrics exporter, cache warmer,
+				// etc. once per key instead of once per block.
+				firstConfigInBlock: i == 0,
 			}
 			h.saveConfig(za.String(), cfg)
 		}
@@ -82,14 +134,48 @@ func (h *dnsContext) InspectServerBlocks(sourceFile string, serverBlocks []caddy
 // MakeServers uses the newly-created siteConfigs to create and return a list of server instances.
 func (h *dnsContext) MakeServers() ([]caddy.Server, error) {
 
+	// A server block that lists several zone keys (e.g. "example.com
+	// example.net") gets one *Config per key so each zone can be
+	// routed independently, but its OnStartup, OnShutdown and
+	// OnFinalShutdown callbacks must still run exactly once per block,
+	// not once per key. OnStartup is invoked right here, so skipping it
+	// for every config but the block's first is enough; OnShutdown and
+	// OnFinalShutdown are invoked per Config elsewhere in the server
+	// lifecycle, so the only way to dedupe those is to keep them from
+	// ever reaching a non-first Config in the first place.
+	for _, cfg := range h.configs {
+		if !cfg.firstConfigInBlock {
+			cfg.OnShutdown = nil
+			cfg.OnFinalShutdown = nil
+			continue
+		}
+		for _, fn := range cfg.OnStartup {
+			if err := fn(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// we must map (group) each config to a bind address
 	groups, err := groupConfigsByListenAddr(h.configs)
 	if err != nil {
 		return nil, err
 	}
-	// then we create a server for each group
+	// then we create a server for each group, applying any "servers"
+	// overrides - name, timeouts, concurrency limit - that target this
+	// bind address.
 	var servers []caddy.Server
 	for addr, group := range groups {
+		if so, ok := h.serverOpts[addr]; ok {
+			for _, conf := range group {
+				conf.ServerName = so.Name
+				conf.ReadTimeout = so.ReadTimeout
+				conf.WriteTimeout = so.WriteTimeout
+				conf.IdleTimeout = so.IdleTimeout
+				conf.MaxConcurrentQueries = so.MaxConcurrentQueries
+			}
+		}
+
 		s, err := NewServer(addr, group)
 		if err != nil {
 			return nil, err
@@ -97,6 +183,11 @@ func (h *dnsContext) MakeServers() ([]caddy.Server, error) {
 		servers = append(servers, s)
 	}
 
+	// Every server for the reloaded Corefile built successfully - if
+	// this process is a gracefulRestart child, tell the parent it's
+	// safe to give up its own listeners now.
+	signalGracefulRestartReady()
+
 	return servers, nil
 }
 
@@ -105,66 +196,828 @@ func (c *Config) AddMiddleware(m middleware.Middleware) {
 	c.Middleware = append(c.Middleware, m)
 }
 
+// resolveListenAddr turns a network plus the host/port (or socket
+// selector) it was parsed with into the ParsedNetworkAddress coredns
+// actually binds and groups listeners by - the single source of truth
+// both groupConfigsByListenAddr (for zone keys) and InspectServerBlocks
+// (for "servers" addresses) resolve through, so the two agree on what
+// counts as "the same bind address".
+func resolveListenAddr(network, host, port, socketName, socketPath string) (ParsedNetworkAddress, error) {
+	switch network {
+	case "unix":
+		return ParsedNetworkAddress{Network: network, Host: socketPath}, nil
+	case "fd", "fdgram":
+		return ParsedNetworkAddress{Network: network, Host: socketName}, nil
+	}
+
+	if port == "" {
+		port = Port
+	}
+	// "." is normalizeZone's stand-in for "no host given" (e.g. the
+	// wildcard ".:53" Corefile default); resolve it the same way an
+	// empty host resolves, to the wildcard address, instead of handing
+	// the literal "." to net.ResolveTCPAddr, which looks it up as a
+	// hostname and fails.
+	if host == "." {
+		host = ""
+	}
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return ParsedNetworkAddress{}, err
+	}
+	// An empty/"." host resolves to a *TCPAddr with a nil IP - the
+	// wildcard address - not to 0.0.0.0. addr.IP.String() would render
+	// that nil as the literal text "<nil>", which net.Listen then fails
+	// to resolve as a hostname; keep Host "" instead, the same string
+	// net.JoinHostPort(host, port) already treats as "bind everywhere".
+	resolvedHost := ""
+	if addr.IP != nil {
+		resolvedHost = addr.IP.String()
+	}
+	return ParsedNetworkAddress{Network: network, Host: resolvedHost, Port: strconv.Itoa(addr.Port)}, nil
+}
+
 // groupSiteConfigsByListenAddr groups site configs by their listen
 // (bind) address, so sites that use the same listener can be served
 // on the same server instance. The return value maps the listen
 // address (what you pass into net.Listen) to the list of site configs.
 // This function does NOT vet the configs to ensure they are compatible.
 func groupConfigsByListenAddr(configs []*Config) (map[string][]*Config, error) {
+	// Whatever an inherited listener or packet conn's address didn't
+	// match any Config below - e.g. a zone removed or readdressed
+	// across this restart - would otherwise sit open for the rest of
+	// the process's life.
+	defer closeLeftoverInheritedSockets()
+
 	groups := make(map[string][]*Config)
 
+	// bound caches the listener/packet conn already bound for a given
+	// address string, so that zone keys sharing an address (e.g. two
+	// zones on the same :53) bind it once instead of each grabbing - or
+	// fighting over - their own socket.
+	bound := make(map[string]boundGroup)
+
 	for _, conf := range configs {
+		if conf.Network == "" {
+			conf.Network = defaultNetwork
+		}
 		if conf.Port == "" {
 			conf.Port = Port
 		}
-		if conf.Port == "sa" {
-			port, err := setupSockets()
+		if conf.Port == "sa" || conf.Network == "fd" || conf.Network == "fdgram" {
+			l, p, err := setupSockets(conf.SocketName)
 			if err != nil {
+				closeBoundGroups(bound)
 				return nil, fmt.Errorf("Can't setup socket activation: %s", err.Error())
 			}
-			conf.Port = port
+			conf.SocketListener = l
+			conf.SocketPacketConn = p
 			conf.isSocketActivated = true
+
+			// Only the "sa" (tcp/udp-by-name) case needs conf.Port
+			// backfilled with whatever port systemd actually bound -
+			// resolveListenAddr's fd/fdgram branch keys on SocketName
+			// alone and never reads conf.Port, so this would be
+			// discarded anyway there. Skipping it there also means a
+			// systemd socket unit for something other than TCP/UDP -
+			// e.g. a unix socket selected via "fd/3" - never hits these
+			// type assertions and can't panic the process.
+			if conf.Port == "sa" {
+				switch {
+				case l != nil:
+					if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok {
+						conf.Port = strconv.Itoa(tcpAddr.Port)
+					}
+				case p != nil:
+					if udpAddr, ok := p.LocalAddr().(*net.UDPAddr); ok {
+						conf.Port = strconv.Itoa(udpAddr.Port)
+					}
+				}
+			}
 		}
-		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.ListenHost, conf.Port))
+
+		pna, err := resolveListenAddr(conf.Network, conf.ListenHost, conf.Port, conf.SocketName, conf.SocketPath)
 		if err != nil {
+			closeBoundGroups(bound)
 			return nil, err
 		}
-		addrstr := addr.String()
+
+		// Now that the bind address is resolved, a zone served twice on
+		// the very same (network, host, port) is genuinely ambiguous -
+		// coredns wouldn't know which config to route a query to.
+		addrstr := pna.String()
+		for _, existing := range groups[addrstr] {
+			if existing.Zone == conf.Zone {
+				closeBoundGroups(bound)
+				return nil, fmt.Errorf("cannot serve %s - zone already defined for %s", conf.Zone, addrstr)
+			}
+		}
+
+		// Systemd-activated sockets are already bound above. Everything
+		// else binds here - instead of leaving it to NewServer - so a
+		// listener inherited from a parent process during a graceful
+		// restart can be reused instead of binding (and failing to bind)
+		// a fresh one, and so every listener this process serves on gets
+		// registered for the *next* graceful restart to hand down in turn.
+		if !conf.isSocketActivated {
+			bg, ok := bound[addrstr]
+			if !ok {
+				l, p, err := bindGroup(pna)
+				if err != nil {
+					closeBoundGroups(bound)
+					return nil, fmt.Errorf("can't listen on %s: %s", addrstr, err)
+				}
+				bg = boundGroup{listener: l, packetConn: p}
+				bound[addrstr] = bg
+			}
+			conf.SocketListener = bg.listener
+			conf.SocketPacketConn = bg.packetConn
+		}
+
 		groups[addrstr] = append(groups[addrstr], conf)
 	}
 
 	return groups, nil
 }
 
-func setupSockets() (string, error) {
-	if socketActivatedListener == nil {
-		listeners, err := activation.Listeners(false)
-		if err != nil {
-			return "", err
+// closeBoundGroups closes every socket groupConfigsByListenAddr has
+// bound so far, so a config error partway through a Corefile doesn't
+// leave earlier zones' listeners orphaned and holding their port (or, on
+// a unix socket, their path) for the life of the process.
+func closeBoundGroups(bound map[string]boundGroup) {
+	for _, bg := range bound {
+		if bg.listener != nil {
+			bg.listener.Close()
+		}
+		if bg.packetConn != nil {
+			bg.packetConn.Close()
 		}
-		packetConns, err := activation.PacketConns(true)
+	}
+}
+
+// boundGroup holds the listener and/or packet conn already bound for one
+// address string, so every Config sharing that address can be handed the
+// same sockets instead of each binding its own.
+type boundGroup struct {
+	listener   net.Listener
+	packetConn net.PacketConn
+}
+
+// bindGroup binds the stream listener and/or packet conn pna calls for -
+// both for "tcp", the historic tcp-and-udp default (also when written
+// as an explicit "tcp/" prefix); one or the other for any other
+// network - preferring a listener inherited from a parent
+// process over binding a fresh one, and registering whichever it binds
+// so a future graceful restart can hand it down in turn. bindListener
+// and bindPacketConn only bind; registration happens here, once bindGroup
+// knows the whole group bound cleanly, so a later failure never leaves a
+// closed socket behind in activeListeners/activePacketConns.
+func bindGroup(pna ParsedNetworkAddress) (net.Listener, net.PacketConn, error) {
+	if pna.Network == "unix" {
+		l, err := bindListener("unix", pna.Host)
 		if err != nil {
-			return "", err
+			return nil, nil, err
+		}
+		registerActiveListener(l)
+		return l, nil, nil
+	}
+
+	var l net.Listener
+	var p net.PacketConn
+	addr := net.JoinHostPort(pna.Host, pna.Port)
+
+	switch pna.Network {
+	case "tcp", "tcp4", "tcp6", "tcp-tls":
+		network := pna.Network
+		if network == "tcp-tls" {
+			network = "tcp"
 		}
-		for _, l := range listeners {
+		var err error
+		if l, err = bindListener(network, addr); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch pna.Network {
+	case "tcp", "udp", "udp4", "udp6":
+		network := "udp"
+		if pna.Network != "tcp" {
+			network = pna.Network
+		}
+		var err error
+		if p, err = bindPacketConn(network, addr); err != nil {
 			if l != nil {
-				socketActivatedListener = l
+				l.Close()
+			}
+			return nil, nil, err
+		}
+	}
+
+	if l != nil {
+		registerActiveListener(l)
+	}
+	if p != nil {
+		registerActivePacketConn(p)
+	}
+	return l, p, nil
+}
+
+// bindListener returns a stream listener for network/addr, reusing a
+// listener inherited from a parent during a graceful restart when one
+// bound to this exact addr is still unclaimed, and binding a fresh one
+// otherwise. The caller registers it once the whole group it belongs to
+// has bound successfully.
+func bindListener(network, addr string) (net.Listener, error) {
+	if l := claimInheritedListener(addr); l != nil {
+		return l, nil
+	}
+
+	return net.Listen(network, addr)
+}
+
+// bindPacketConn is bindListener's counterpart for datagram sockets.
+func bindPacketConn(network, addr string) (net.PacketConn, error) {
+	if p := claimInheritedPacketConn(addr); p != nil {
+		return p, nil
+	}
+
+	return net.ListenPacket(network, addr)
+}
+
+// activationFdStart is the first file descriptor systemd hands a
+// socket-activated process, per sd_listen_fds(3); descriptors 0-2 are
+// stdin/stdout/stderr.
+const activationFdStart = 3
+
+// socketsOnce loads every socket this process received via systemd
+// socket activation exactly once, keyed by FileDescriptorName and by its
+// real descriptor number ("3", "4", ...) so a zone key can select a
+// specific socket - by name or by the descriptor systemd actually
+// assigned it - instead of the old all-or-nothing single-socket
+// behavior.
+var (
+	socketsOnce      sync.Once
+	socketsErr       error
+	namedListeners   map[string]net.Listener
+	namedPacketConns map[string]net.PacketConn
+)
+
+func loadSockets() {
+	files := activation.Files(false)
+
+	namedListeners = make(map[string]net.Listener)
+	namedPacketConns = make(map[string]net.PacketConn)
+
+	for i, f := range files {
+		fd := activationFdStart + i
+		fdKey := strconv.Itoa(fd)
+
+		if l, err := net.FileListener(f); err == nil {
+			f.Close()
+			namedListeners[fdKey] = l
+			if f.Name() != "" {
+				namedListeners[f.Name()] = l
 			}
+			continue
 		}
-		for _, p := range packetConns {
-			if p != nil {
-				socketActivatedPacketConn = p
+		if p, err := net.FilePacketConn(f); err == nil {
+			f.Close()
+			namedPacketConns[fdKey] = p
+			if f.Name() != "" {
+				namedPacketConns[f.Name()] = p
 			}
+			continue
 		}
-		if socketActivatedListener == nil {
-			return "", errors.New("No listeners")
+		socketsErr = fmt.Errorf("inherited descriptor %d (%s) is neither a stream nor a datagram socket", fd, f.Name())
+		return
+	}
+}
+
+// setupSockets returns the socket-activated listener and/or packet
+// connection matching name. An empty name falls back to one listener
+// and one packet connection among all those received, matching the
+// historic all-or-nothing behavior; which ones are picked when there
+// are several is not defined.
+func setupSockets(name string) (net.Listener, net.PacketConn, error) {
+	socketsOnce.Do(loadSockets)
+	if socketsErr != nil {
+		return nil, nil, socketsErr
+	}
+
+	if name == "" {
+		var l net.Listener
+		var p net.PacketConn
+		for _, v := range namedListeners {
+			l = v
+			break
+		}
+		for _, v := range namedPacketConns {
+			p = v
+			break
 		}
-		if socketActivatedPacketConn == nil {
-			return "", errors.New("No packet connections")
+		if l == nil && p == nil {
+			return nil, nil, errors.New("no socket-activated listeners")
 		}
+		return l, p, nil
+	}
+
+	l, p := namedListeners[name], namedPacketConns[name]
+	if l == nil && p == nil {
+		return nil, nil, fmt.Errorf("no socket-activated listener named %q", name)
 	}
-	port := socketActivatedListener.Addr().(*net.TCPAddr).Port
-	return strconv.Itoa(port), nil
+	return l, p, nil
+}
+
+// Graceful restarts work by handing every listener and packet
+// connection this process holds to a freshly-exec'd copy of itself,
+// via os.ExtraFiles, so the replacement can start serving before the
+// parent stops. gracefulRestart writes every listener's fd first, then
+// every packet conn's, so the child needs to know where that split
+// falls, not just the total - it learns both through these environment
+// variables. It also passes an ack pipe fd through the same mechanism,
+// named by gracefulEnvAckFD, so the parent can tell whether the child
+// actually came up on the reloaded Corefile before giving up its own
+// sockets.
+const (
+	gracefulEnvListenFDs       = "COREDNS_LISTEN_FDS"
+	gracefulEnvListenStreamFDs = "COREDNS_LISTEN_STREAM_FDS"
+	gracefulEnvListenPIDs      = "COREDNS_LISTEN_PIDS"
+	gracefulEnvAckFD           = "COREDNS_GRACEFUL_ACK_FD"
+)
+
+// childReadyTimeout bounds how long gracefulRestart waits for the
+// replacement process to signal, via the ack pipe, that it loaded the
+// reloaded Corefile successfully. If the child doesn't make it in time -
+// or exits, or signals failure - the parent keeps its own listeners and
+// never hands off, so a bad reload leaves the last-known-good config
+// serving instead of taking the whole service down with it.
+const childReadyTimeout = 10 * time.Second
+
+var (
+	// activeListenersMu guards activeListeners and activePacketConns.
+	activeListenersMu sync.Mutex
+
+	// activeListeners and activePacketConns record every socket this
+	// process bound itself, in the order they were bound; systemd
+	// socket-activated sockets are not recorded here. bindGroup
+	// registers into these once each group it binds succeeds in full,
+	// so a graceful restart can hand them down in the same order and a
+	// group that fails to fully bind never leaves a socket registered.
+	activeListeners   []net.Listener
+	activePacketConns []net.PacketConn
+
+	// inheritedListeners and inheritedPacketConns hold the sockets this
+	// process inherited from a parent during a graceful restart, each
+	// tagged with the address it was actually bound to so bindListener
+	// and bindPacketConn can claim the one a zone asks for by address,
+	// not by position - a zone added, removed or reordered in the
+	// Corefile across the restart must never hand an unrelated listener
+	// to the wrong Config. groupConfigsByListenAddr runs once, single
+	// threaded, at startup, so claiming these needs no locking.
+	inheritedListeners, inheritedPacketConns = loadInheritedSockets()
+)
+
+// inheritedListener is a stream listener inherited from a parent during
+// a graceful restart.
+type inheritedListener struct {
+	net.Listener
+	addr    string
+	claimed bool
+}
+
+// inheritedPacketConn is inheritedListener's counterpart for datagram
+// sockets.
+type inheritedPacketConn struct {
+	net.PacketConn
+	addr    string
+	claimed bool
+}
+
+// registerActiveListener records l so a future graceful restart can
+// hand it down to its replacement process.
+func registerActiveListener(l net.Listener) {
+	activeListenersMu.Lock()
+	activeListeners = append(activeListeners, l)
+	activeListenersMu.Unlock()
+}
+
+// registerActivePacketConn records p so a future graceful restart can
+// hand it down to its replacement process.
+func registerActivePacketConn(p net.PacketConn) {
+	activeListenersMu.Lock()
+	activePacketConns = append(activePacketConns, p)
+	activeListenersMu.Unlock()
+}
+
+// ackOnce guards signalGracefulRestartReady, so a second call - MakeServers
+// can in principle run more than once in a process's life - doesn't try
+// to write to an fd it already closed.
+var ackOnce sync.Once
+
+// signalGracefulRestartReady tells this process's gracefulRestart parent,
+// if any, that it loaded the reloaded Corefile successfully and built
+// every server for it, by writing a byte to the ack pipe fd named in
+// gracefulEnvAckFD and closing it. It's a no-op on a normal startup, when
+// that env var is unset.
+func signalGracefulRestartReady() {
+	ackOnce.Do(func() {
+		fdStr := os.Getenv(gracefulEnvAckFD)
+		if fdStr == "" {
+			return
+		}
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			return
+		}
+		f := os.NewFile(uintptr(fd), "graceful-restart-ack")
+		if f == nil {
+			return
+		}
+		defer f.Close()
+		f.Write([]byte{1})
+	})
+}
+
+// loadInheritedFiles reconstructs the *os.File slice a parent process
+// handed down via os.ExtraFiles, using gracefulEnvListenFDs to know how
+// many were passed. It returns nil when this process was not started as
+// part of a graceful restart.
+func loadInheritedFiles() []*os.File {
+	countStr := os.Getenv(gracefulEnvListenFDs)
+	if countStr == "" {
+		return nil
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count == 0 {
+		return nil
+	}
+	// fd 0, 1 and 2 are stdin, stdout and stderr; inherited sockets
+	// start at 3.
+	files := make([]*os.File, count)
+	for i := 0; i < count; i++ {
+		files[i] = os.NewFile(uintptr(3+i), fmt.Sprintf("inherited-%d", i))
+	}
+	return files
+}
+
+// loadInheritedStreamCount reads gracefulEnvListenStreamFDs, the number
+// of leading entries among the inherited fds that are stream listeners
+// rather than packet conns. It returns 0 when this process was not
+// started as part of a graceful restart.
+func loadInheritedStreamCount() int {
+	n, err := strconv.Atoi(os.Getenv(gracefulEnvListenStreamFDs))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// loadInheritedSockets splits the fds this process inherited from a
+// parent during a graceful restart into stream listeners and packet
+// conns, per loadInheritedStreamCount, and wraps each as a net.Listener
+// or net.PacketConn tagged with its bound address so bindListener and
+// bindPacketConn can claim the one they're actually looking for. Returns
+// nil, nil when this process was not started as part of a graceful
+// restart.
+func loadInheritedSockets() ([]*inheritedListener, []*inheritedPacketConn) {
+	files := loadInheritedFiles()
+	if files == nil {
+		return nil, nil
+	}
+	streamCount := loadInheritedStreamCount()
+	if streamCount > len(files) {
+		streamCount = len(files)
+	}
+
+	listeners := make([]*inheritedListener, 0, streamCount)
+	for _, f := range files[:streamCount] {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("[WARNING] inherited fd %s is not a usable listener: %s", f.Name(), err)
+			continue
+		}
+		listeners = append(listeners, &inheritedListener{Listener: l, addr: addrMatchKey(l.Addr().String())})
+	}
+
+	packetConns := make([]*inheritedPacketConn, 0, len(files)-streamCount)
+	for _, f := range files[streamCount:] {
+		p, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			log.Printf("[WARNING] inherited fd %s is not a usable packet conn: %s", f.Name(), err)
+			continue
+		}
+		packetConns = append(packetConns, &inheritedPacketConn{PacketConn: p, addr: addrMatchKey(p.LocalAddr().String())})
+	}
+	return listeners, packetConns
+}
+
+// addrMatchKey normalizes a bind address string - either what
+// bindListener/bindPacketConn were asked for, or what an inherited
+// socket's Addr()/LocalAddr() reports - into a form that compares equal
+// for "the same address" regardless of how each side spells a wildcard
+// host. net.Listen(":53").Addr().String() comes back as "[::]:53" or
+// "0.0.0.0:53" depending on platform, while a bind request for the same
+// address is the bare ":53" JoinHostPort produces for an empty host;
+// both mean "every address" but wouldn't compare equal as raw strings.
+// A unix socket path has no host:port to normalize, so it's compared
+// as-is.
+func addrMatchKey(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" {
+		return net.JoinHostPort("", port)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return net.JoinHostPort("", port)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// claimInheritedListener returns the inherited stream listener already
+// bound to addr, if this process inherited one during a graceful
+// restart and nothing has claimed it yet, or nil otherwise - including
+// on a normal startup, when there are none to begin with.
+func claimInheritedListener(addr string) net.Listener {
+	key := addrMatchKey(addr)
+	for _, il := range inheritedListeners {
+		if !il.claimed && il.addr == key {
+			il.claimed = true
+			return il.Listener
+		}
+	}
+	return nil
+}
+
+// claimInheritedPacketConn is claimInheritedListener's counterpart for
+// datagram sockets.
+func claimInheritedPacketConn(addr string) net.PacketConn {
+	key := addrMatchKey(addr)
+	for _, ip := range inheritedPacketConns {
+		if !ip.claimed && ip.addr == key {
+			ip.claimed = true
+			return ip.PacketConn
+		}
+	}
+	return nil
+}
+
+// closeLeftoverInheritedSockets closes every inherited listener and
+// packet conn nothing claimed - e.g. belonging to a zone removed from
+// the Corefile across this restart - so they don't linger open for the
+// rest of the process's life.
+func closeLeftoverInheritedSockets() {
+	for _, il := range inheritedListeners {
+		if !il.claimed {
+			il.Close()
+		}
+	}
+	for _, ip := range inheritedPacketConns {
+		if !ip.claimed {
+			ip.Close()
+		}
+	}
+}
+
+// trapSignalsForGracefulRestart starts a goroutine that triggers a
+// graceful restart whenever this process receives SIGUSR1 or SIGHUP, so
+// operators can reload the Corefile - including plugin and zone changes
+// - without dropping in-flight queries.
+func trapSignalsForGracefulRestart() {
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGUSR1, syscall.SIGHUP)
+	go func() {
+		for range sigchan {
+			if err := gracefulRestart(); err != nil {
+				log.Printf("[ERROR] graceful restart failed: %s", err)
+			}
+		}
+	}()
+}
+
+// gracefulRestart execs a copy of the running binary, handing off every
+// listener and packet connection currently registered in
+// activeListeners/activePacketConns so the child can pick up the
+// reloaded Corefile and start serving immediately - but only gives up
+// the parent's own copies once the child has acked, over a pipe handed
+// down the same way, that it actually loaded the new Corefile; see
+// childReadyTimeout. Once that happens, listenerFile and packetConnFile
+// already dup'd the underlying fd, so the parent's own copies no longer
+// serve any purpose but to keep accepting new work on a config that's
+// being replaced - gracefulRestart closes them right away so the parent
+// stops racing the child for new connections and datagrams. Whatever the
+// parent already had in flight keeps running - closing a listener
+// doesn't touch accepted connections - for up to GracefulTimeout, after
+// which the process exits regardless.
+func gracefulRestart() error {
+	activeListenersMu.Lock()
+	listeners := make([]net.Listener, len(activeListeners))
+	copy(listeners, activeListeners)
+	packetConns := make([]net.PacketConn, len(activePacketConns))
+	copy(packetConns, activePacketConns)
+	activeListenersMu.Unlock()
+
+	files := make([]*os.File, 0, len(listeners)+len(packetConns))
+	for _, l := range listeners {
+		f, err := listenerFile(l)
+		if err != nil {
+			return fmt.Errorf("dup listener %s: %s", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	for _, p := range packetConns {
+		f, err := packetConnFile(p)
+		if err != nil {
+			return fmt.Errorf("dup packet conn %s: %s", p.LocalAddr(), err)
+		}
+		files = append(files, f)
+	}
+
+	ackRead, ackWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create ready pipe: %s", err)
+	}
+	defer ackRead.Close()
+	ackFD := 3 + len(files)
+	files = append(files, ackWrite)
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	child := exec.Command(execPath, os.Args[1:]...)
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	child.ExtraFiles = files
+	child.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", gracefulEnvListenFDs, len(files)-1),
+		fmt.Sprintf("%s=%d", gracefulEnvListenStreamFDs, len(listeners)),
+		fmt.Sprintf("%s=%d", gracefulEnvListenPIDs, os.Getpid()),
+		fmt.Sprintf("%s=%d", gracefulEnvAckFD, ackFD),
+	)
+	if err := child.Start(); err != nil {
+		ackWrite.Close()
+		return err
+	}
+	// The parent never writes to the pipe, only reads; closing its copy
+	// of the write end here means ackRead sees EOF if the child exits
+	// (or is killed) without ever signaling ready.
+	ackWrite.Close()
+
+	ready := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := ackRead.Read(buf)
+		ready <- n > 0
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- child.Wait()
+	}()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			child.Process.Kill()
+			return fmt.Errorf("restart child %d closed its ready pipe without signaling success", child.Process.Pid)
+		}
+	case err := <-exited:
+		return fmt.Errorf("restart child %d exited before signaling ready: %v", child.Process.Pid, err)
+	case <-time.After(childReadyTimeout):
+		child.Process.Kill()
+		return fmt.Errorf("restart child %d did not signal ready within %s", child.Process.Pid, childReadyTimeout)
+	}
+
+	// The child now holds its own dup'd fds for every listener and
+	// packet conn above; closing the parent's copies stops it from
+	// accepting anything new without affecting the child at all.
+	for _, l := range listeners {
+		// A unix listener would otherwise unlink its socket path on
+		// Close, leaving the child's copy unreachable.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+	for _, p := range packetConns {
+		p.Close()
+	}
+
+	log.Printf("[INFO] Restart child %d is up; draining within %s", child.Process.Pid, GracefulTimeout)
+	go func() {
+		time.Sleep(GracefulTimeout)
+		os.Exit(0)
+	}()
+	return nil
+}
+
+// listenerFile returns the *os.File backing l, suitable for passing to
+// a child process via os.ExtraFiles.
+func listenerFile(l net.Listener) (*os.File, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	f, ok := l.(filer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported listener type %T", l)
+	}
+	return f.File()
+}
+
+// packetConnFile returns the *os.File backing p, suitable for passing
+// to a child process via os.ExtraFiles.
+func packetConnFile(p net.PacketConn) (*os.File, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	f, ok := p.(filer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported packet conn type %T", p)
+	}
+	return f.File()
+}
+
+// ServerOptions holds per-bind-address tuning knobs set via a "servers"
+// directive, independent of any single zone. They let operators name a
+// server (for metrics/log labels) and tune its timeouts and concurrency
+// without repeating those settings on every zone that happens to share
+// the address.
+type ServerOptions struct {
+	// Name labels this server in metrics and logs.
+	Name string
+
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	MaxConcurrentQueries int
+}
+
+// parseServerOptions parses one or more "servers" directives, e.g.:
+//
+//	servers 127.0.0.1:53 {
+//	    name internal
+//	    timeouts 2s 2s 10s
+//	    max_concurrent 1000
+//	}
+//
+// into the *ServerOptions each describes, keyed by the bind address
+// they were declared for.
+func parseServerOptions(d *caddyfile.Dispenser) (map[string]*ServerOptions, error) {
+	opts := map[string]*ServerOptions{}
+	for d.Next() {
+		args := d.RemainingArgs()
+		if len(args) != 1 {
+			return nil, fmt.Errorf("servers: expected exactly one bind address, got %v", args)
+		}
+		addr := args[0]
+
+		so := &ServerOptions{Name: addr}
+		for d.NextBlock() {
+			switch d.Val() {
+			case "name":
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				so.Name = d.Val()
+
+			case "timeouts":
+				timeoutArgs := d.RemainingArgs()
+				if len(timeoutArgs) != 3 {
+					return nil, fmt.Errorf("servers: timeouts expects read, write and idle durations")
+				}
+				var err error
+				if so.ReadTimeout, err = time.ParseDuration(timeoutArgs[0]); err != nil {
+					return nil, err
+				}
+				if so.WriteTimeout, err = time.ParseDuration(timeoutArgs[1]); err != nil {
+					return nil, err
+				}
+				if so.IdleTimeout, err = time.ParseDuration(timeoutArgs[2]); err != nil {
+					return nil, err
+				}
+
+			case "max_concurrent":
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return nil, err
+				}
+				so.MaxConcurrentQueries = n
+
+			default:
+				return nil, fmt.Errorf("servers: unknown property %q", d.Val())
+			}
+		}
+		opts[addr] = so
+	}
+	return opts, nil
 }
 
 const (
@@ -183,7 +1036,4 @@ var (
 
 	// Quiet mode will not show any informative output on initialization.
 	Quiet bool
-
-	socketActivatedListener   net.Listener
-	socketActivatedPacketConn net.PacketConn
 )
@@ -0,0 +1,94 @@
+package dnsserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddyfile"
+)
+
+// TestServerOptionsLandOnConfig proves a "servers" override actually
+// reaches the Config it targets: parseServerOptions and
+// groupConfigsByListenAddr must agree on what counts as "the same bind
+// address" for MakeServers' h.serverOpts[addr] lookup to ever succeed.
+func TestServerOptionsLandOnConfig(t *testing.T) {
+	const addr = "127.0.0.1:0"
+
+	d := caddyfile.NewDispenser("Testfile", strings.NewReader("servers "+addr+" {\n    name internal\n}\n"))
+	opts, err := parseServerOptions(d)
+	if err != nil {
+		t.Fatalf("parseServerOptions: %s", err)
+	}
+	so, ok := opts[addr]
+	if !ok {
+		t.Fatalf("parseServerOptions: no entry for %q in %v", addr, opts)
+	}
+
+	za, err := normalizeZone(addr)
+	if err != nil {
+		t.Fatalf("normalizeZone: %s", err)
+	}
+	pna, err := resolveListenAddr(za.Network, za.Zone, za.Port, za.SocketName, za.SocketPath)
+	if err != nil {
+		t.Fatalf("resolveListenAddr: %s", err)
+	}
+	serverOpts := map[string]*ServerOptions{pna.String(): so}
+
+	// The zone binds the host the override names, as a "bind 127.0.0.1"
+	// directive would set it.
+	conf := &Config{Zone: za.Zone, Port: za.Port, Network: za.Network, ListenHost: za.Zone}
+	groups, err := groupConfigsByListenAddr([]*Config{conf})
+	if err != nil {
+		t.Fatalf("groupConfigsByListenAddr: %s", err)
+	}
+	defer func() {
+		if conf.SocketListener != nil {
+			conf.SocketListener.Close()
+		}
+		if conf.SocketPacketConn != nil {
+			conf.SocketPacketConn.Close()
+		}
+	}()
+
+	group, ok := groups[pna.String()]
+	if !ok {
+		t.Fatalf("groupConfigsByListenAddr: no group for %q among %v", pna.String(), groups)
+	}
+
+	// This is what MakeServers does: look up the override by the
+	// group's own address key.
+	for addr, group := range groups {
+		matched, ok := serverOpts[addr]
+		if !ok {
+			continue
+		}
+		for _, c := range group {
+			c.ServerName = matched.Name
+		}
+	}
+
+	if len(group) != 1 || group[0] != conf {
+		t.Fatalf("unexpected group contents: %v", group)
+	}
+	if conf.ServerName != "internal" {
+		t.Fatalf("conf.ServerName = %q, want %q - servers override never matched the group", conf.ServerName, "internal")
+	}
+}
+
+// TestResolveListenAddrWildcardHost proves "." - normalizeZone's
+// stand-in for "no host given", e.g. the wildcard ".:53" Corefile
+// default - resolves to the wildcard address instead of being handed to
+// net.ResolveTCPAddr as a literal hostname, where it fails to resolve.
+func TestResolveListenAddrWildcardHost(t *testing.T) {
+	pna, err := resolveListenAddr("tcp", ".", "53", "", "")
+	if err != nil {
+		t.Fatalf("resolveListenAddr: %s", err)
+	}
+	want, err := resolveListenAddr("tcp", "", "53", "", "")
+	if err != nil {
+		t.Fatalf("resolveListenAddr: %s", err)
+	}
+	if pna != want {
+		t.Fatalf("resolveListenAddr(%q) = %+v, want %+v (same as empty host)", ".", pna, want)
+	}
+}